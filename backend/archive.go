@@ -0,0 +1,401 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveSources maps a transfer id to the directory it packs into a tar
+// stream. Kept separate from the temp-file convention used for single-file
+// transfers since an archive is never materialized on disk as a whole.
+var archiveSources = make(map[string]string)
+
+// sendFolder accepts either a server-side directory path or a set of
+// uploaded files and registers them as a single archive transfer. The tar
+// itself is never built here - it's streamed lazily, entry by entry, the
+// first time the receiver pulls /api/blob.
+func sendFolder(w http.ResponseWriter, r *http.Request) {
+	targetIP := r.FormValue("targetIP")
+	if targetIP == "" {
+		http.Error(w, "Target IP required", http.StatusBadRequest)
+		return
+	}
+	secure := r.FormValue("secure") == "true"
+
+	uploadLimit, err := parseRateLimit(r.FormValue("uploadLimit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	downloadLimit, err := parseRateLimit(r.FormValue("downloadLimit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sourceRoot, archiveName, err := resolveFolderSource(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entryCount, totalSize, err := walkArchiveSource(sourceRoot, func(string, os.FileInfo) error { return nil })
+	if err != nil {
+		http.Error(w, "Error scanning folder: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	transferID := fmt.Sprintf("%d", time.Now().UnixNano())
+	transfer := &FileTransfer{
+		ID:            transferID,
+		Filename:      archiveName + ".tar",
+		Size:          totalSize,
+		From:          deviceName,
+		To:            targetIP,
+		Status:        "pending",
+		FromIP:        getLocalIP(),
+		Secure:        secure,
+		IsArchive:     true,
+		EntryCount:    entryCount,
+		TotalSize:     totalSize,
+		UploadLimit:   uploadLimit,
+		DownloadLimit: downloadLimit,
+	}
+
+	if secure {
+		codePhrase, err := newCodePhrase()
+		if err != nil {
+			http.Error(w, "Error generating code phrase", http.StatusInternalServerError)
+			return
+		}
+		transfer.CodePhrase = codePhrase
+		transfer.Status = "waiting_for_code"
+
+		if err := startPakeSession(transferID, codePhrase); err != nil {
+			http.Error(w, "Error starting secure session", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	transferRegistry.Upsert(transfer)
+	archiveSources[transferID] = sourceRoot
+
+	go notifyPeerOfTransfer(targetIP, transfer)
+
+	if secure {
+		// Broadcast a value copy, not the live registry pointer: see the same
+		// fix in sendFile.
+		if copy, ok := transferRegistry.CopyOf(transferID); ok {
+			broadcastMessage("transfer_waiting_for_code", copy)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		*FileTransfer
+		CodePhrase string `json:"codePhrase,omitempty"`
+	}{transfer, transfer.CodePhrase})
+}
+
+// resolveFolderSource figures out what directory to archive: either a
+// server-side path supplied directly (the common case for a CLI/desktop
+// client), or a set of files uploaded via multipart form, which get staged
+// into a per-transfer directory first so they can be walked the same way.
+func resolveFolderSource(r *http.Request) (root string, name string, err error) {
+	if path := r.FormValue("path"); path != "" {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", "", fmt.Errorf("path not found: %w", err)
+		}
+		if !info.IsDir() {
+			return "", "", fmt.Errorf("path is not a directory")
+		}
+		return path, filepath.Base(path), nil
+	}
+
+	if err := r.ParseMultipartForm(256 << 20); err != nil {
+		return "", "", fmt.Errorf("error parsing form: %w", err)
+	}
+	files := r.MultipartForm.File["files"]
+	if len(files) == 0 {
+		return "", "", fmt.Errorf("no path or files provided")
+	}
+
+	stageDir := filepath.Join(os.TempDir(), "file-share", "staged", fmt.Sprintf("%d", time.Now().UnixNano()))
+	for _, fh := range files {
+		// Browsers that support folder upload send the relative path as the
+		// filename (e.g. "photos/2024/beach.jpg").
+		relPath := filepath.Clean(fh.Filename)
+		if strings.HasPrefix(relPath, "..") {
+			continue
+		}
+
+		dest := filepath.Join(stageDir, relPath)
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			return "", "", err
+		}
+
+		src, err := fh.Open()
+		if err != nil {
+			return "", "", err
+		}
+		out, err := os.Create(dest)
+		if err != nil {
+			src.Close()
+			return "", "", err
+		}
+		io.Copy(out, src)
+		src.Close()
+		out.Close()
+	}
+
+	return stageDir, "upload", nil
+}
+
+// gitignoreMatcher is a deliberately simple .gitignore reader: it matches
+// each non-comment line against a path's segments with filepath.Match. It
+// doesn't implement the full gitignore spec (negation, "**", anchoring),
+// just enough to skip the obvious build/dependency noise in a folder send.
+type gitignoreMatcher struct {
+	patterns []string
+}
+
+func loadGitignore(root string) *gitignoreMatcher {
+	f, err := os.Open(filepath.Join(root, ".gitignore"))
+	if err != nil {
+		return &gitignoreMatcher{}
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.Trim(line, "/"))
+	}
+	return &gitignoreMatcher{patterns: patterns}
+}
+
+func (g *gitignoreMatcher) shouldIgnore(relPath string) bool {
+	for _, p := range g.patterns {
+		if ok, _ := filepath.Match(p, relPath); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(p, filepath.Base(relPath)); ok {
+			return true
+		}
+		if strings.HasPrefix(relPath, p+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkArchiveSource walks root (honoring its top-level .gitignore) and
+// invokes visit for every regular file that would go into the archive.
+func walkArchiveSource(root string, visit func(relPath string, info os.FileInfo) error) (entryCount int, totalSize int64, err error) {
+	ignore := loadGitignore(root)
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if relPath == "." {
+			return nil
+		}
+		if ignore.shouldIgnore(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if err := visit(relPath, info); err != nil {
+			return err
+		}
+		entryCount++
+		totalSize += info.Size()
+		return nil
+	})
+	return entryCount, totalSize, err
+}
+
+// streamArchiveBlob tars up the transfer's source directory and writes it
+// (through the transfer's usual secure-mode framing) to dst. The tar writer
+// feeds an io.Pipe so the (optional) AES-GCM framing in copyForTransfer can
+// treat it like any other byte stream, without ever staging the archive on
+// disk. Shared by serveArchiveBlob (HTTP) and serveBlobViaRelay, since an
+// archive transfer has no temp file on disk for the relay path to open.
+func streamArchiveBlob(dst io.Writer, transfer *FileTransfer) error {
+	root, ok := archiveSources[transfer.ID]
+	if !ok {
+		return fmt.Errorf("archive source not found for transfer %s", transfer.ID)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		_, _, err := walkArchiveSource(root, func(relPath string, info os.FileInfo) error {
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(relPath)
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+
+			f, err := os.Open(filepath.Join(root, relPath))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			_, err = io.Copy(tw, f)
+			return err
+		})
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := tw.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+
+	return copyForTransfer(dst, pr, transfer)
+}
+
+// serveArchiveBlob streams the transfer's source directory as a tar archive
+// over HTTP.
+func serveArchiveBlob(w http.ResponseWriter, transfer *FileTransfer) {
+	if _, ok := archiveSources[transfer.ID]; !ok {
+		http.Error(w, "Archive source not found", http.StatusNotFound)
+		return
+	}
+
+	rl := registerTransferLimiter(transfer.ID, effectiveLimit(transfer.UploadLimit, defaultUploadLimitBps))
+	defer cancelTransferLimiter(transfer.ID)
+	throttled := &throttledResponseWriter{ResponseWriter: w, rl: rl}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Accept-Ranges", "none")
+	if err := streamArchiveBlob(throttled, transfer); err != nil {
+		log.Printf("Error streaming archive for transfer %s: %v", transfer.ID, err)
+	}
+}
+
+// pullArchiveFromSender pulls the tar stream from the sender (direct or via
+// relay, same as a single-file pull) and extracts it entry by entry into a
+// per-transfer subdirectory, so nothing but the final files touch disk.
+func pullArchiveFromSender(transfer *FileTransfer) {
+	src, _, err := openBlobSource(transfer, 0)
+	if err != nil {
+		log.Printf("Error pulling archive for transfer %s: %v", transfer.ID, err)
+		return
+	}
+	defer src.Close()
+
+	extractDir := filepath.Join(os.TempDir(), "file-share", transfer.ID)
+	if err := os.MkdirAll(extractDir, 0o755); err != nil {
+		log.Printf("Error creating extract dir for transfer %s: %v", transfer.ID, err)
+		return
+	}
+
+	rl := registerTransferLimiter(transfer.ID, effectiveLimit(transfer.DownloadLimit, defaultDownloadLimitBps))
+	defer cancelTransferLimiter(transfer.ID)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(copyFromTransfer(pw, src, transfer))
+	}()
+
+	progress := &progressTrackingWriter{transfer: transfer, total: transfer.TotalSize, lastBeat: time.Now(), rl: rl}
+
+	var entriesWritten int
+	tr := tar.NewReader(pr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error extracting archive for transfer %s: %v", transfer.ID, err)
+			updated, _ := transferRegistry.SetStatus(transfer.ID, "rejected")
+			broadcastMessage("transfer_rejected", updated)
+			return
+		}
+
+		if header.Typeflag == tar.TypeSymlink || header.Typeflag == tar.TypeLink {
+			log.Printf("Skipping link entry %q in archive for transfer %s", header.Name, transfer.ID)
+			continue
+		}
+
+		dest := filepath.Join(extractDir, filepath.FromSlash(header.Name))
+		if rel, err := filepath.Rel(extractDir, dest); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			log.Printf("Skipping entry %q in archive for transfer %s: escapes extract dir", header.Name, transfer.ID)
+			continue
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			os.MkdirAll(dest, 0o755)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+			log.Printf("Error creating directory for %s: %v", dest, err)
+			continue
+		}
+
+		out, err := os.Create(dest)
+		if err != nil {
+			log.Printf("Error creating file %s: %v", dest, err)
+			continue
+		}
+
+		progress.w = &throttledWriter{w: out, rl: rl}
+		_, err = io.Copy(progress, tr)
+		out.Close()
+		if err != nil {
+			log.Printf("Error writing %s: %v", dest, err)
+			continue
+		}
+		entriesWritten++
+	}
+
+	if transfer.EntryCount > 0 && entriesWritten == 0 {
+		log.Printf("Archive transfer %s produced no files (expected %d), rejecting", transfer.ID, transfer.EntryCount)
+		updated, _ := transferRegistry.SetStatus(transfer.ID, "rejected")
+		broadcastMessage("transfer_rejected", updated)
+		return
+	}
+
+	updated, _ := transferRegistry.SetStatus(transfer.ID, "completed")
+	broadcastMessage("transfer_completed", updated)
+	log.Printf("Archive transfer %s extracted to %s", transfer.ID, extractDir)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// multicastAddr is the group/port peers announce themselves on. Any host on
+// a routed network that permits multicast will see announcements regardless
+// of /24 boundaries, unlike the old subnet-scan approach.
+const multicastAddr = "239.255.42.99:9292"
+
+// announcement is the payload peers exchange over the multicast group.
+type announcement struct {
+	Name       string `json:"name"`
+	IP         string `json:"ip"`
+	Port       string `json:"port"`
+	InstanceID string `json:"instanceId"`
+}
+
+// instanceID uniquely identifies this process so it can recognize and
+// discard its own announcements.
+var instanceID = newInstanceID()
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// startMulticastAnnouncer periodically announces this peer on the multicast
+// group so other peers can learn about it passively.
+func startMulticastAnnouncer() {
+	addr, err := net.ResolveUDPAddr("udp4", multicastAddr)
+	if err != nil {
+		log.Printf("Error resolving multicast address: %v", err)
+		return
+	}
+
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		log.Printf("Error dialing multicast group: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	announce := func() {
+		msg := announcement{
+			Name:       deviceName,
+			IP:         getLocalIP(),
+			Port:       serverPort,
+			InstanceID: instanceID,
+		}
+
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return
+		}
+
+		if _, err := conn.Write(data); err != nil {
+			log.Printf("Error sending multicast announcement: %v", err)
+		}
+	}
+
+	announce()
+	for range ticker.C {
+		announce()
+	}
+}
+
+// startMulticastListener listens on the multicast group and learns peers
+// passively as their announcements arrive.
+func startMulticastListener() {
+	addr, err := net.ResolveUDPAddr("udp4", multicastAddr)
+	if err != nil {
+		log.Printf("Error resolving multicast address: %v", err)
+		return
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	if err != nil {
+		log.Printf("Error joining multicast group: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.SetReadBuffer(8192)
+
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("Error reading multicast packet: %v", err)
+			continue
+		}
+
+		var msg announcement
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+
+		if msg.InstanceID == instanceID {
+			continue
+		}
+
+		ip := msg.IP
+		if ip == "" {
+			ip = src.IP.String()
+		}
+
+		peer := Peer{
+			Name:       msg.Name,
+			IP:         ip,
+			Port:       msg.Port,
+			InstanceID: msg.InstanceID,
+			LastSeen:   time.Now(),
+			Online:     true,
+		}
+
+		known := peerRegistry.Upsert(peer)
+
+		if !known {
+			broadcastMessage("peer_discovered", peer)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package state
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hub fans out JSON messages to every connected WebSocket client. clients is
+// only ever touched inside Run's select loop, so register/unregister/
+// broadcast can be called freely from other goroutines without racing each
+// other or a concurrent broadcast iteration.
+type Hub struct {
+	clients    map[*websocket.Conn]bool
+	broadcast  chan []byte
+	register   chan *websocket.Conn
+	unregister chan *websocket.Conn
+}
+
+// NewHub creates a Hub with no connected clients. Run must be started in its
+// own goroutine before Register/Unregister/Broadcast are used.
+func NewHub() *Hub {
+	return &Hub{
+		clients:    make(map[*websocket.Conn]bool),
+		broadcast:  make(chan []byte),
+		register:   make(chan *websocket.Conn),
+		unregister: make(chan *websocket.Conn),
+	}
+}
+
+// Run owns clients exclusively for the Hub's lifetime.
+func (h *Hub) Run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				client.Close()
+			}
+
+		case message := <-h.broadcast:
+			for client := range h.clients {
+				if err := client.WriteMessage(websocket.TextMessage, message); err != nil {
+					delete(h.clients, client)
+					client.Close()
+				}
+			}
+		}
+	}
+}
+
+// Register adds a newly-upgraded connection to the hub.
+func (h *Hub) Register(conn *websocket.Conn) {
+	h.register <- conn
+}
+
+// Unregister removes a connection, e.g. once its read loop exits.
+func (h *Hub) Unregister(conn *websocket.Conn) {
+	h.unregister <- conn
+}
+
+// Broadcast marshals msgType/data as {"type", "data"} and sends it to every
+// connected client.
+func (h *Hub) Broadcast(msgType string, data interface{}) {
+	message := map[string]interface{}{
+		"type": msgType,
+		"data": data,
+	}
+
+	jsonData, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Error marshaling message:", err)
+		return
+	}
+
+	h.broadcast <- jsonData
+}
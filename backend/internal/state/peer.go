@@ -0,0 +1,116 @@
+// Package state centralizes the server's shared, concurrently-accessed
+// state - known peers, in-flight transfers, and connected WebSocket clients -
+// behind small registries so every goroutine that touches them (the
+// multicast listener, the discovery sweep, HTTP handlers, transfer
+// goroutines) goes through a lock instead of racing on a bare map.
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// Peer is a discovered device willing to send/receive files.
+type Peer struct {
+	Name       string    `json:"name"`
+	IP         string    `json:"ip"`
+	Port       string    `json:"port"`
+	InstanceID string    `json:"instanceId"`
+	LastSeen   time.Time `json:"lastSeen"`
+	Online     bool      `json:"online"`
+}
+
+// PeerRegistry guards the set of known peers behind a single RWMutex.
+// Methods take and return Peer by value so callers never hold a pointer into
+// the registry's internal map - the one prior source of data races, since a
+// Peer handed out for JSON encoding could otherwise be mutated mid-encode by
+// the discovery sweep.
+type PeerRegistry struct {
+	mu    sync.RWMutex
+	peers map[string]Peer
+}
+
+// NewPeerRegistry creates an empty registry.
+func NewPeerRegistry() *PeerRegistry {
+	return &PeerRegistry{peers: make(map[string]Peer)}
+}
+
+// Upsert records a peer announcement, returning whether that peer was
+// already known (so callers can decide whether to broadcast a "discovered"
+// event).
+func (r *PeerRegistry) Upsert(p Peer) (known bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, known = r.peers[p.IP]
+	r.peers[p.IP] = p
+	return known
+}
+
+// Get returns the peer known at the given IP, if any.
+func (r *PeerRegistry) Get(ip string) (Peer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.peers[ip]
+	return p, ok
+}
+
+// Snapshot returns every peer the registry currently knows about.
+func (r *PeerRegistry) Snapshot() []Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]Peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		out = append(out, p)
+	}
+	return out
+}
+
+// Online returns only the peers currently marked online.
+func (r *PeerRegistry) Online() []Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]Peer, 0, len(r.peers))
+	for _, p := range r.peers {
+		if p.Online {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// MarkOffline flips a single peer's Online flag off and returns its updated
+// value, so the caller can broadcast it.
+func (r *PeerRegistry) MarkOffline(ip string) (Peer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[ip]
+	if !ok || !p.Online {
+		return Peer{}, false
+	}
+	p.Online = false
+	r.peers[ip] = p
+	return p, true
+}
+
+// Prune marks peers unseen for longer than staleAfter as offline and forgets
+// peers unseen for longer than forgetAfter entirely. It returns the peers
+// that transitioned to offline during this sweep, for the caller to
+// broadcast once the lock is released.
+func (r *PeerRegistry) Prune(staleAfter, forgetAfter time.Duration) []Peer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var wentOffline []Peer
+	for ip, p := range r.peers {
+		if time.Since(p.LastSeen) > forgetAfter {
+			delete(r.peers, ip)
+			continue
+		}
+		if p.Online && time.Since(p.LastSeen) > staleAfter {
+			p.Online = false
+			r.peers[ip] = p
+			wentOffline = append(wentOffline, p)
+		}
+	}
+	return wentOffline
+}
@@ -0,0 +1,79 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPeerRegistryConcurrent hammers a single registry from many goroutines
+// at once - discovery announcements, reads, and the prune sweep - so `go
+// test -race` catches any access to the underlying map that isn't going
+// through the mutex.
+func TestPeerRegistryConcurrent(t *testing.T) {
+	const numPeers = 50
+	const numRounds = 20
+
+	reg := NewPeerRegistry()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numPeers; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			for round := 0; round < numRounds; round++ {
+				reg.Upsert(Peer{
+					Name:     fmt.Sprintf("peer-%s", ip),
+					IP:       ip,
+					Online:   true,
+					LastSeen: time.Now(),
+				})
+				reg.Get(ip)
+				reg.Online()
+				reg.Snapshot()
+			}
+		}(ip)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < numRounds; round++ {
+			reg.Prune(time.Millisecond, time.Hour)
+		}
+	}()
+
+	wg.Wait()
+
+	if len(reg.Snapshot()) == 0 {
+		t.Fatal("expected at least one peer to survive the run")
+	}
+}
+
+func TestPeerRegistryUpsertReportsKnown(t *testing.T) {
+	reg := NewPeerRegistry()
+	p := Peer{IP: "10.0.0.1", Online: true}
+
+	if known := reg.Upsert(p); known {
+		t.Fatal("first Upsert of a new peer should report known=false")
+	}
+	if known := reg.Upsert(p); !known {
+		t.Fatal("second Upsert of the same peer should report known=true")
+	}
+}
+
+func TestPeerRegistryMarkOffline(t *testing.T) {
+	reg := NewPeerRegistry()
+	reg.Upsert(Peer{IP: "10.0.0.1", Online: true})
+
+	updated, ok := reg.MarkOffline("10.0.0.1")
+	if !ok || updated.Online {
+		t.Fatalf("expected peer to be marked offline, got %+v (ok=%v)", updated, ok)
+	}
+
+	if _, ok := reg.MarkOffline("10.0.0.1"); ok {
+		t.Fatal("marking an already-offline peer offline again should report ok=false")
+	}
+}
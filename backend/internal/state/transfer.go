@@ -0,0 +1,153 @@
+package state
+
+import "sync"
+
+// FileTransfer tracks one file (or archive) moving between two peers.
+type FileTransfer struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Status   string `json:"status"` // pending, accepted, rejected, completed, waiting_for_code
+	FromIP   string `json:"fromIP"`
+
+	// Hash is the SHA-256 of the file, computed as the sender ingests it, so
+	// the receiver can verify the assembled file once the pull completes.
+	Hash string `json:"hash"`
+
+	// Secure mode: PAKE-authenticated end-to-end encryption. CodePhrase is
+	// only ever handed back to the peer that generated it, never broadcast
+	// or relayed to the other side - that defeats the point of a PAKE.
+	Secure     bool   `json:"secure"`
+	CodePhrase string `json:"-"`
+
+	// Relay is the room code peers rendezvous under on the relay server when
+	// a direct dial between them fails. Empty means the transfer hasn't
+	// needed the relay (yet).
+	Relay string `json:"relay,omitempty"`
+
+	// Archive transfers (a folder, or multiple files sent together) are
+	// packed into a tar stream on the fly rather than a single blob.
+	IsArchive  bool  `json:"isArchive,omitempty"`
+	EntryCount int   `json:"entryCount,omitempty"`
+	TotalSize  int64 `json:"totalSize,omitempty"`
+
+	// UploadLimit/DownloadLimit override the process-wide -upload-limit /
+	// -download-limit for this transfer alone, in bytes/sec. Zero means
+	// "use the default".
+	UploadLimit   float64 `json:"uploadLimit,omitempty"`
+	DownloadLimit float64 `json:"downloadLimit,omitempty"`
+}
+
+// TransferRegistry guards the set of in-flight transfers behind a single
+// RWMutex. Unlike PeerRegistry it still hands out live *FileTransfer
+// pointers via Get, since the rest of the server threads a transfer through
+// several goroutines (PAKE handshake, pull, relay fallback) that need to see
+// each other's updates - only the map itself needs to be race-free. Status
+// changes, the one field mutated from many different call sites, go through
+// SetStatus so they're serialized and safe to broadcast.
+type TransferRegistry struct {
+	mu        sync.RWMutex
+	transfers map[string]*FileTransfer
+}
+
+// NewTransferRegistry creates an empty registry.
+func NewTransferRegistry() *TransferRegistry {
+	return &TransferRegistry{transfers: make(map[string]*FileTransfer)}
+}
+
+// Upsert records a new transfer, or replaces an existing one with the same
+// ID.
+func (r *TransferRegistry) Upsert(t *FileTransfer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers[t.ID] = t
+}
+
+// Get returns the transfer with the given ID, if any.
+func (r *TransferRegistry) Get(id string) (*FileTransfer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.transfers[id]
+	return t, ok
+}
+
+// CopyOf returns a value copy of the transfer with the given ID, safe to
+// broadcast or otherwise hand to a goroutine that shouldn't see - or race -
+// later mutations made through the live pointer Get hands out.
+func (r *TransferRegistry) CopyOf(id string) (FileTransfer, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.transfers[id]
+	if !ok {
+		return FileTransfer{}, false
+	}
+	return *t, true
+}
+
+// Snapshot returns every transfer the registry currently knows about.
+func (r *TransferRegistry) Snapshot() []*FileTransfer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]*FileTransfer, 0, len(r.transfers))
+	for _, t := range r.transfers {
+		out = append(out, t)
+	}
+	return out
+}
+
+// SetStatus updates a transfer's status and returns a value copy of the
+// transfer as it looked immediately after the update, so the caller can
+// broadcast it without racing a concurrent SetStatus on the same transfer.
+func (r *TransferRegistry) SetStatus(id, status string) (FileTransfer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transfers[id]
+	if !ok {
+		return FileTransfer{}, false
+	}
+	t.Status = status
+	return *t, true
+}
+
+// SetHash records the sender-computed SHA-256 once ingestion finishes, so
+// the receiver can verify the assembled file against it. Routing the write
+// through the registry (rather than setting the field directly on a pointer
+// handed out by Get) keeps it from racing concurrent readers, e.g. a
+// Snapshot serving the transfer list mid-ingest.
+func (r *TransferRegistry) SetHash(id, hash string) (FileTransfer, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transfers[id]
+	if !ok {
+		return FileTransfer{}, false
+	}
+	t.Hash = hash
+	return *t, true
+}
+
+// RelayRoomCode returns the room code a transfer rendezvous under on the
+// relay, assigning one derived from the transfer ID the first time it's
+// needed. Callers - the relay-info handler, openBlobSource, and
+// serveBlobViaRelay - run concurrently and would otherwise race writing
+// Relay directly, so the assignment happens here under the registry lock.
+func (r *TransferRegistry) RelayRoomCode(id string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transfers[id]
+	if !ok {
+		return "", false
+	}
+	if t.Relay == "" {
+		t.Relay = "room-" + t.ID
+	}
+	return t.Relay, true
+}
+
+// Delete forgets a transfer, e.g. once its temp files have been cleaned up.
+func (r *TransferRegistry) Delete(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.transfers, id)
+}
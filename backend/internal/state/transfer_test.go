@@ -0,0 +1,71 @@
+package state
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestTransferRegistryConcurrent spins up many fake transfers, each mutated
+// by its own goroutine while every goroutine also reads the whole registry
+// via Snapshot, so `go test -race` catches any unsynchronized map access.
+func TestTransferRegistryConcurrent(t *testing.T) {
+	const numTransfers = 50
+	const numRounds = 20
+
+	reg := NewTransferRegistry()
+	statuses := []string{"pending", "accepted", "completed", "rejected"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < numTransfers; i++ {
+		id := fmt.Sprintf("transfer-%d", i)
+		reg.Upsert(&FileTransfer{ID: id, Status: "pending"})
+
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for round := 0; round < numRounds; round++ {
+				reg.SetStatus(id, statuses[round%len(statuses)])
+				reg.Get(id)
+				reg.Snapshot()
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	for i := 0; i < numTransfers; i++ {
+		id := fmt.Sprintf("transfer-%d", i)
+		if _, ok := reg.Get(id); !ok {
+			t.Fatalf("expected transfer %s to still be registered", id)
+		}
+	}
+}
+
+func TestTransferRegistrySetStatusReturnsSnapshot(t *testing.T) {
+	reg := NewTransferRegistry()
+	reg.Upsert(&FileTransfer{ID: "t1", Status: "pending"})
+
+	updated, ok := reg.SetStatus("t1", "accepted")
+	if !ok || updated.Status != "accepted" {
+		t.Fatalf("expected status accepted, got %+v (ok=%v)", updated, ok)
+	}
+
+	live, _ := reg.Get("t1")
+	if live.Status != "accepted" {
+		t.Fatalf("expected live transfer to reflect the new status, got %q", live.Status)
+	}
+
+	if _, ok := reg.SetStatus("missing", "accepted"); ok {
+		t.Fatal("SetStatus on an unknown transfer should report ok=false")
+	}
+}
+
+func TestTransferRegistryDelete(t *testing.T) {
+	reg := NewTransferRegistry()
+	reg.Upsert(&FileTransfer{ID: "t1"})
+	reg.Delete("t1")
+
+	if _, ok := reg.Get("t1"); ok {
+		t.Fatal("expected transfer to be gone after Delete")
+	}
+}
@@ -2,48 +2,32 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
-	"mime/multipart"
 	"net"
 	"net/http"
 	"os"
 	"os/user"
 	"path/filepath"
-	"strings"
 	"time"
 
+	"file-share-app/internal/state"
+
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
 )
 
-type Peer struct {
-	Name     string    `json:"name"`
-	IP       string    `json:"ip"`
-	Port     string    `json:"port"`
-	LastSeen time.Time `json:"lastSeen"`
-	Online   bool      `json:"online"`
-}
-
-type FileTransfer struct {
-	ID       string `json:"id"`
-	Filename string `json:"filename"`
-	Size     int64  `json:"size"`
-	From     string `json:"from"`
-	To       string `json:"to"`
-	Status   string `json:"status"` // pending, accepted, rejected, completed
-	FromIP   string `json:"fromIP"`
-}
-
-type Hub struct {
-	clients    map[*websocket.Conn]bool
-	broadcast  chan []byte
-	register   chan *websocket.Conn
-	unregister chan *websocket.Conn
-}
+// Peer and FileTransfer are aliased from the state package so the rest of
+// this file (and the other files in package main) can keep referring to
+// them by their original names.
+type Peer = state.Peer
+type FileTransfer = state.FileTransfer
 
 var (
 	upgrader = websocket.Upgrader{
@@ -52,17 +36,16 @@ var (
 		},
 	}
 
-	hub = &Hub{
-		clients:    make(map[*websocket.Conn]bool),
-		broadcast:  make(chan []byte),
-		register:   make(chan *websocket.Conn),
-		unregister: make(chan *websocket.Conn),
-	}
+	hub = state.NewHub()
+
+	peerRegistry     = state.NewPeerRegistry()
+	transferRegistry = state.NewTransferRegistry()
+	deviceName       string
+	serverPort       = "8080"
 
-	peers      = make(map[string]*Peer)
-	transfers  = make(map[string]*FileTransfer)
-	deviceName string
-	serverPort = "8080"
+	// relayAddr is the optional public relay server (set via -relay) used as
+	// a fallback when two peers can't dial each other directly.
+	relayAddr string
 )
 
 func init() {
@@ -76,12 +59,37 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "relay" {
+		relayCmd := flag.NewFlagSet("relay", flag.ExitOnError)
+		listenAddr := relayCmd.String("listen", ":9090", "address for the relay server to listen on")
+		relayCmd.Parse(os.Args[2:])
+
+		runRelayServer(*listenAddr)
+		return
+	}
+
+	flag.StringVar(&relayAddr, "relay", "", "address of a public relay server to fall back to when peers can't reach each other directly")
+	flag.StringVar(&uploadLimitFlag, "upload-limit", "", "cap outgoing transfer bandwidth, e.g. \"10MB/s\" (default unlimited)")
+	flag.StringVar(&downloadLimitFlag, "download-limit", "", "cap incoming transfer bandwidth, e.g. \"10MB/s\" (default unlimited)")
+	flag.Parse()
+
+	var err error
+	defaultUploadLimitBps, err = parseRateLimit(uploadLimitFlag)
+	if err != nil {
+		log.Fatalf("Invalid -upload-limit: %v", err)
+	}
+	defaultDownloadLimitBps, err = parseRateLimit(downloadLimitFlag)
+	if err != nil {
+		log.Fatalf("Invalid -download-limit: %v", err)
+	}
+
 	// Start WebSocket hub
-	go hub.run()
+	go hub.Run()
 
 	// Start peer discovery
 	go startPeerDiscovery()
-	go startDiscoveryBroadcast()
+	go startMulticastListener()
+	go startMulticastAnnouncer()
 
 	// Setup routes
 	r := mux.NewRouter()
@@ -92,13 +100,18 @@ func main() {
 	// API endpoints
 	r.HandleFunc("/api/peers", getPeers).Methods("GET")
 	r.HandleFunc("/api/send", sendFile).Methods("POST")
+	r.HandleFunc("/api/send-folder", sendFolder).Methods("POST")
 	r.HandleFunc("/api/download/{transferId}", downloadFile).Methods("GET")
 	r.HandleFunc("/api/accept/{transferId}", acceptTransfer).Methods("POST")
 	r.HandleFunc("/api/accept-remote/{transferId}", acceptRemoteTransfer).Methods("POST")
 	r.HandleFunc("/api/reject/{transferId}", rejectTransfer).Methods("POST")
 	r.HandleFunc("/api/notify-transfer", notifyTransfer).Methods("POST")
 	r.HandleFunc("/api/device-name", getDeviceName).Methods("GET")
-	r.HandleFunc("/api/upload/{transferId}", receiveFileFromSender).Methods("POST")
+	r.HandleFunc("/api/pake/{transferId}", handlePake).Methods("POST")
+	r.HandleFunc("/api/blob/{transferId}", serveBlob).Methods("GET")
+	r.HandleFunc("/api/relay-info", getRelayInfo).Methods("GET")
+	r.HandleFunc("/api/relay-fallback/{transferId}", startRelayFallback).Methods("POST")
+	r.HandleFunc("/api/transfers/{id}/limit", setTransferLimit).Methods("PUT")
 
 	// Discovery endpoint
 	r.HandleFunc("/discover", handleDiscovery).Methods("GET")
@@ -117,30 +130,6 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+serverPort, handler))
 }
 
-func (h *Hub) run() {
-	for {
-		select {
-		case client := <-h.register:
-			h.clients[client] = true
-
-		case client := <-h.unregister:
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				client.Close()
-			}
-
-		case message := <-h.broadcast:
-			for client := range h.clients {
-				err := client.WriteMessage(websocket.TextMessage, message)
-				if err != nil {
-					delete(h.clients, client)
-					client.Close()
-				}
-			}
-		}
-	}
-}
-
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -148,12 +137,10 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	hub.register <- conn
+	hub.Register(conn)
 
 	go func() {
-		defer func() {
-			hub.unregister <- conn
-		}()
+		defer hub.Unregister(conn)
 
 		for {
 			_, _, err := conn.ReadMessage()
@@ -165,18 +152,7 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 }
 
 func broadcastMessage(msgType string, data interface{}) {
-	message := map[string]interface{}{
-		"type": msgType,
-		"data": data,
-	}
-
-	jsonData, err := json.Marshal(message)
-	if err != nil {
-		log.Println("Error marshaling message:", err)
-		return
-	}
-
-	hub.broadcast <- jsonData
+	hub.Broadcast(msgType, data)
 }
 
 func getLocalIP() string {
@@ -190,112 +166,25 @@ func getLocalIP() string {
 	return localAddr.IP.String()
 }
 
-func startDiscoveryBroadcast() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			broadcastDiscovery()
-		}
-	}
-}
-
-func broadcastDiscovery() {
-	// Get local network interfaces
-	interfaces, err := net.Interfaces()
-	if err != nil {
-		return
-	}
-
-	for _, iface := range interfaces {
-		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
-			continue
-		}
-
-		addrs, err := iface.Addrs()
-		if err != nil {
-			continue
-		}
-
-		for _, addr := range addrs {
-			ipnet, ok := addr.(*net.IPNet)
-			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
-				continue
-			}
-
-			// Broadcast to subnet
-			broadcast := make(net.IP, 4)
-			for i := range ipnet.IP.To4() {
-				broadcast[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[i]
-			}
-
-			go sendDiscoveryPacket(broadcast.String())
-		}
-	}
-}
-
-func sendDiscoveryPacket(broadcastIP string) {
-	// Simple HTTP-based discovery
-	client := &http.Client{Timeout: 2 * time.Second}
-
-	// Try common ports in the subnet
-	baseIP := broadcastIP[:strings.LastIndex(broadcastIP, ".")]
-	for i := 1; i < 255; i++ {
-		targetIP := fmt.Sprintf("%s.%d", baseIP, i)
-		if targetIP == getLocalIP() {
-			continue
-		}
-
-		go func(ip string) {
-			resp, err := client.Get(fmt.Sprintf("http://%s:%s/discover", ip, serverPort))
-			if err != nil {
-				return
-			}
-			defer resp.Body.Close()
-
-			var peer Peer
-			if err := json.NewDecoder(resp.Body).Decode(&peer); err != nil {
-				return
-			}
-
-			peer.IP = ip
-			peer.LastSeen = time.Now()
-			peer.Online = true
-
-			peers[peer.IP] = &peer
-			broadcastMessage("peer_discovered", peer)
-		}(targetIP)
-	}
-}
-
 func startPeerDiscovery() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for {
-		select {
-		case <-ticker.C:
-			// Clean up offline peers
-			for ip, peer := range peers {
-				if time.Since(peer.LastSeen) > 60*time.Second {
-					peer.Online = false
-					broadcastMessage("peer_offline", peer)
-				}
-				if time.Since(peer.LastSeen) > 300*time.Second {
-					delete(peers, ip)
-				}
-			}
+	for range ticker.C {
+		for _, peer := range peerRegistry.Prune(60*time.Second, 300*time.Second) {
+			broadcastMessage("peer_offline", peer)
 		}
 	}
 }
 
 func handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	// Fallback for peers on a different subnet or with multicast blocked: a
+	// user can point this device at a known host/IP and hit /discover directly.
 	peer := Peer{
-		Name: deviceName,
-		IP:   getLocalIP(),
-		Port: serverPort,
+		Name:       deviceName,
+		IP:         getLocalIP(),
+		Port:       serverPort,
+		InstanceID: instanceID,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -303,15 +192,8 @@ func handleDiscovery(w http.ResponseWriter, r *http.Request) {
 }
 
 func getPeers(w http.ResponseWriter, r *http.Request) {
-	peerList := make([]*Peer, 0, len(peers))
-	for _, peer := range peers {
-		if peer.Online {
-			peerList = append(peerList, peer)
-		}
-	}
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(peerList)
+	json.NewEncoder(w).Encode(peerRegistry.Online())
 }
 
 func getDeviceName(w http.ResponseWriter, r *http.Request) {
@@ -340,19 +222,50 @@ func sendFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	secure := r.FormValue("secure") == "true"
+
+	uploadLimit, err := parseRateLimit(r.FormValue("uploadLimit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	downloadLimit, err := parseRateLimit(r.FormValue("downloadLimit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// Create transfer record
 	transferID := fmt.Sprintf("%d", time.Now().UnixNano())
 	transfer := &FileTransfer{
-		ID:       transferID,
-		Filename: header.Filename,
-		Size:     header.Size,
-		From:     deviceName,
-		To:       targetIP,
-		Status:   "pending",
-		FromIP:   getLocalIP(),
+		ID:            transferID,
+		Filename:      header.Filename,
+		Size:          header.Size,
+		From:          deviceName,
+		To:            targetIP,
+		Status:        "pending",
+		FromIP:        getLocalIP(),
+		Secure:        secure,
+		UploadLimit:   uploadLimit,
+		DownloadLimit: downloadLimit,
+	}
+
+	if secure {
+		codePhrase, err := newCodePhrase()
+		if err != nil {
+			http.Error(w, "Error generating code phrase", http.StatusInternalServerError)
+			return
+		}
+		transfer.CodePhrase = codePhrase
+		transfer.Status = "waiting_for_code"
+
+		if err := startPakeSession(transferID, codePhrase); err != nil {
+			http.Error(w, "Error starting secure session", http.StatusInternalServerError)
+			return
+		}
 	}
 
-	transfers[transferID] = transfer
+	transferRegistry.Upsert(transfer)
 
 	// Save file temporarily on sender side
 	tempDir := filepath.Join(os.TempDir(), "file-share")
@@ -366,13 +279,31 @@ func sendFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tempFile.Close()
 
-	io.Copy(tempFile, file)
+	hasher := sha256.New()
+	io.Copy(io.MultiWriter(tempFile, hasher), file)
+	transferRegistry.SetHash(transferID, hex.EncodeToString(hasher.Sum(nil)))
 
 	// Notify target peer about the transfer
 	go notifyPeerOfTransfer(targetIP, transfer)
 
+	if secure {
+		// Broadcast a value copy, not the live registry pointer: once the
+		// transfer is registered, other handlers (e.g. acceptRemoteTransfer via
+		// SetStatus) can update it concurrently, and json.Marshal-ing the
+		// pointer directly would race them.
+		if copy, ok := transferRegistry.CopyOf(transferID); ok {
+			broadcastMessage("transfer_waiting_for_code", copy)
+		}
+	}
+
+	// The code phrase is only ever handed back to the sender that generated
+	// it here in the direct HTTP response - it must never be relayed to the
+	// receiving peer, which has to obtain it out-of-band.
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(transfer)
+	json.NewEncoder(w).Encode(struct {
+		*FileTransfer
+		CodePhrase string `json:"codePhrase,omitempty"`
+	}{transfer, transfer.CodePhrase})
 }
 
 func notifyTransfer(w http.ResponseWriter, r *http.Request) {
@@ -382,7 +313,7 @@ func notifyTransfer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	transfers[transfer.ID] = &transfer
+	transferRegistry.Upsert(&transfer)
 	broadcastMessage("transfer_request", transfer)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -409,22 +340,39 @@ func acceptTransfer(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	transferID := vars["transferId"]
 
-	transfer, exists := transfers[transferID]
+	transfer, exists := transferRegistry.Get(transferID)
 	if !exists {
 		http.Error(w, "Transfer not found", http.StatusNotFound)
 		return
 	}
 
-	transfer.Status = "accepted"
-	broadcastMessage("transfer_accepted", transfer)
+	if transfer.Secure {
+		var body struct {
+			CodePhrase string `json:"codePhrase"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
 
-	// Notify sender to start file transfer
+		if err := completePakeHandshake(transfer, body.CodePhrase); err != nil {
+			log.Printf("PAKE handshake failed for transfer %s: %v", transferID, err)
+			updated, _ := transferRegistry.SetStatus(transferID, "rejected")
+			broadcastMessage("transfer_rejected", updated)
+			http.Error(w, "Secure handshake failed", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	updated, _ := transferRegistry.SetStatus(transferID, "accepted")
+	broadcastMessage("transfer_accepted", updated)
+
+	// Let the sender know we've accepted (so it can update its own UI), then
+	// pull the file ourselves - the sender just serves /api/blob.
 	if transfer.FromIP != "" {
 		go notifySenderOfAcceptance(transfer.FromIP, transfer.ID)
+		go pullFileFromSender(transfer)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(transfer)
+	json.NewEncoder(w).Encode(updated)
 }
 
 func notifySenderOfAcceptance(senderIP, transferID string) {
@@ -441,186 +389,19 @@ func notifySenderOfAcceptance(senderIP, transferID string) {
 	defer resp.Body.Close()
 }
 
-func requestFileFromSender(transfer *FileTransfer) {
-	// Find sender's IP from the transfer.From field
-	// We need to extract IP from device name or use a mapping
-	// For now, let's assume transfer.From contains the IP or we find it in peers
-	var senderIP string
-	for ip, peer := range peers {
-		if peer.Name == transfer.From {
-			senderIP = ip
-			break
-		}
-	}
-
-	if senderIP == "" {
-		log.Printf("Could not find sender IP for transfer %s", transfer.ID)
-		return
-	}
-
-	// Request the file from sender
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(fmt.Sprintf("http://%s:%s/api/upload/%s", senderIP, serverPort, transfer.ID))
-	if err != nil {
-		log.Printf("Error requesting file from sender: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	log.Printf("Requested file from sender %s for transfer %s", senderIP, transfer.ID)
-}
-
-func receiveFileFromSender(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	transferID := vars["transferId"]
-
-	transfer, exists := transfers[transferID]
-	if !exists {
-		// This might be a cross-device transfer, try to get file from sender
-		log.Printf("Transfer %s not found locally, attempting to fetch from sender", transferID)
-
-		// Parse the form to get file
-		err := r.ParseMultipartForm(32 << 20)
-		if err != nil {
-			http.Error(w, "Failed to parse form", http.StatusBadRequest)
-			return
-		}
-
-		file, header, err := r.FormFile("file")
-		if err != nil {
-			http.Error(w, "File not found in form", http.StatusBadRequest)
-			return
-		}
-		defer file.Close()
-
-		// Save the file
-		tempDir := filepath.Join(os.TempDir(), "file-share")
-		os.MkdirAll(tempDir, 0o755)
-		tempPath := filepath.Join(tempDir, transferID+"_"+header.Filename)
-
-		out, err := os.Create(tempPath)
-		if err != nil {
-			http.Error(w, "Failed to create file", http.StatusInternalServerError)
-			return
-		}
-		defer out.Close()
-
-		io.Copy(out, file)
-
-		// Create transfer record if it doesn't exist
-		transfer = &FileTransfer{
-			ID:       transferID,
-			Filename: header.Filename,
-			Size:     header.Size,
-			From:     r.FormValue("from"),
-			To:       deviceName,
-			Status:   "completed",
-		}
-		transfers[transferID] = transfer
-
-		broadcastMessage("transfer_completed", transfer)
-		log.Printf("File received and saved for transfer %s", transferID)
-
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "received"})
-		return
-	}
-
-	// If transfer exists, this is the sender uploading the file
-	if transfer.Status != "accepted" {
-		http.Error(w, "Transfer not accepted", http.StatusBadRequest)
-		return
-	}
-
-	err := r.ParseMultipartForm(32 << 20)
-	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
-		return
-	}
-
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		// This endpoint was called by receiver to get file from sender
-		log.Printf("Sender serving file for transfer %s", transferID)
-
-		tempDir := filepath.Join(os.TempDir(), "file-share")
-		tempPath := filepath.Join(tempDir, transferID+"_"+transfer.Filename)
-
-		fileData, err := os.Open(tempPath)
-		if err != nil {
-			http.Error(w, "File not found", http.StatusNotFound)
-			return
-		}
-		defer fileData.Close()
-
-		// Upload file to receiver
-		body := &bytes.Buffer{}
-		writer := multipart.NewWriter(body)
-		part, err := writer.CreateFormFile("file", transfer.Filename)
-		if err != nil {
-			log.Println("Error creating form file:", err)
-			return
-		}
-		io.Copy(part, fileData)
-		writer.WriteField("from", transfer.From)
-		writer.Close()
-
-		// Send to receiver
-		receiverIP := transfer.To
-		uploadURL := fmt.Sprintf("http://%s:%s/api/upload/%s", receiverIP, serverPort, transfer.ID)
-		client := &http.Client{Timeout: 30 * time.Second}
-		resp, err := client.Post(uploadURL, writer.FormDataContentType(), body)
-		if err != nil {
-			log.Printf("Error uploading file to receiver: %v", err)
-			http.Error(w, "Failed to upload to receiver", http.StatusInternalServerError)
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == http.StatusOK {
-			transfer.Status = "completed"
-			broadcastMessage("transfer_completed", transfer)
-			log.Printf("File successfully sent to receiver for transfer %s", transferID)
-		}
-
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-	defer file.Close()
-
-	// Save received file
-	tempDir := filepath.Join(os.TempDir(), "file-share")
-	os.MkdirAll(tempDir, 0o755)
-	tempPath := filepath.Join(tempDir, transferID+"_"+header.Filename)
-
-	out, err := os.Create(tempPath)
-	if err != nil {
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
-		return
-	}
-	defer out.Close()
-
-	io.Copy(out, file)
-
-	transfer.Status = "completed"
-	broadcastMessage("transfer_completed", transfer)
-
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "uploaded"})
-}
-
 func rejectTransfer(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	transferID := vars["transferId"]
 
-	transfer, exists := transfers[transferID]
+	transfer, exists := transferRegistry.Get(transferID)
 	if !exists {
 		http.Error(w, "Transfer not found", http.StatusNotFound)
 		return
 	}
 
-	transfer.Status = "rejected"
-	broadcastMessage("transfer_rejected", transfer)
+	updated, _ := transferRegistry.SetStatus(transferID, "rejected")
+	broadcastMessage("transfer_rejected", updated)
+	cancelTransferLimiter(transferID)
 
 	// Clean up temp file
 	tempDir := filepath.Join(os.TempDir(), "file-share")
@@ -628,14 +409,14 @@ func rejectTransfer(w http.ResponseWriter, r *http.Request) {
 	os.Remove(tempPath)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(transfer)
+	json.NewEncoder(w).Encode(updated)
 }
 
 func downloadFile(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	transferID := vars["transferId"]
 
-	transfer, exists := transfers[transferID]
+	transfer, exists := transferRegistry.Get(transferID)
 	if !exists {
 		http.Error(w, "Transfer not found", http.StatusNotFound)
 		return
@@ -659,66 +440,32 @@ func downloadFile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", transfer.Filename))
 	w.Header().Set("Content-Type", "application/octet-stream")
 
-	io.Copy(w, file)
+	rl := registerTransferLimiter(transferID, effectiveLimit(transfer.DownloadLimit, defaultDownloadLimitBps))
+	defer cancelTransferLimiter(transferID)
+	io.Copy(&throttledWriter{w: w, rl: rl}, file)
 
 	// Clean up after download
 	os.Remove(tempPath)
 	log.Printf("File downloaded and cleaned up for transfer %s", transferID)
 }
 
-func pushFileToReceiver(transfer *FileTransfer) {
-	tempDir := filepath.Join(os.TempDir(), "file-share")
-	tempPath := filepath.Join(tempDir, transfer.ID+"_"+transfer.Filename)
-
-	fileData, err := os.Open(tempPath)
-	if err != nil {
-		log.Printf("Error opening file: %v", err)
-		return
-	}
-	defer fileData.Close()
-
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", transfer.Filename)
-	if err != nil {
-		log.Println("Error creating form file:", err)
-		return
-	}
-	io.Copy(part, fileData)
-	writer.Close()
-
-	// Send to receiver
-	uploadURL := fmt.Sprintf("http://%s:%s/api/upload/%s", transfer.To, serverPort, transfer.ID)
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Post(uploadURL, writer.FormDataContentType(), body)
-	if err != nil {
-		log.Printf("Error uploading file to receiver: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		transfer.Status = "completed"
-		broadcastMessage("transfer_completed", transfer)
-	}
-}
-
+// acceptRemoteTransfer runs on the sender, called by notifySenderOfAcceptance
+// once the receiver has accepted and started its own pull. It only mirrors
+// the status into the sender's registry so the sender's own UI/WebSocket
+// feed reflects the acceptance - the sender never pulls bytes from itself,
+// that's pullFileFromSender's job on the receiving side.
 func acceptRemoteTransfer(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	transferID := vars["transferId"]
 
-	transfer, exists := transfers[transferID]
-	if !exists {
+	if _, exists := transferRegistry.Get(transferID); !exists {
 		http.Error(w, "Transfer not found", http.StatusNotFound)
 		return
 	}
 
-	transfer.Status = "accepted"
-	broadcastMessage("transfer_accepted", transfer)
-
-	// Start pushing file to receiver
-	go pushFileToReceiver(transfer)
+	updated, _ := transferRegistry.SetStatus(transferID, "accepted")
+	broadcastMessage("transfer_accepted", updated)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(transfer)
+	json.NewEncoder(w).Encode(updated)
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// limiterBurst bounds how many bytes can move in a single burst above the
+// steady-state rate - generous enough to not choke LAN-sized chunks.
+const limiterBurst = 256 * 1024
+
+var (
+	// uploadLimitFlag / downloadLimitFlag hold the raw -upload-limit /
+	// -download-limit CLI values (e.g. "10MB/s"), resolved into bytes/sec
+	// once at startup.
+	uploadLimitFlag   string
+	downloadLimitFlag string
+
+	defaultUploadLimitBps   float64
+	defaultDownloadLimitBps float64
+
+	limitersMu       sync.Mutex
+	transferLimiters = make(map[string]*rateLimitedTransfer)
+)
+
+// rateLimitedTransfer pairs a transfer's token-bucket limiter with the
+// context that cancels it - cancelling a transfer cancels this context so
+// any goroutine blocked in WaitN returns instead of leaking.
+type rateLimitedTransfer struct {
+	limiter *rate.Limiter
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+var rateLimitPattern = regexp.MustCompile(`(?i)^\s*([0-9.]+)\s*(B|KB|MB|GB)/s\s*$`)
+
+// parseRateLimit turns a string like "10MB/s" into a bytes-per-second rate.
+// An empty string means unlimited.
+func parseRateLimit(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	m := rateLimitPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("invalid rate limit %q, expected e.g. \"10MB/s\"", s)
+	}
+
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	multipliers := map[string]float64{"B": 1, "KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30}
+	return value * multipliers[strings.ToUpper(m[2])], nil
+}
+
+func newLimiter(bytesPerSec float64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return rate.NewLimiter(rate.Inf, limiterBurst)
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSec), limiterBurst)
+}
+
+// effectiveLimit prefers a transfer's own override over the process-wide
+// default.
+func effectiveLimit(override, fallback float64) float64 {
+	if override > 0 {
+		return override
+	}
+	return fallback
+}
+
+// registerTransferLimiter creates (or replaces) the limiter for a transfer.
+// Replacing is fine - it only happens when a pull restarts after a direct
+// dial failed over to the relay.
+func registerTransferLimiter(transferID string, bytesPerSec float64) *rateLimitedTransfer {
+	ctx, cancel := context.WithCancel(context.Background())
+	rl := &rateLimitedTransfer{limiter: newLimiter(bytesPerSec), ctx: ctx, cancel: cancel}
+
+	limitersMu.Lock()
+	if existing, ok := transferLimiters[transferID]; ok {
+		existing.cancel()
+	}
+	transferLimiters[transferID] = rl
+	limitersMu.Unlock()
+
+	return rl
+}
+
+func getTransferLimiter(transferID string) *rateLimitedTransfer {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	return transferLimiters[transferID]
+}
+
+// cancelTransferLimiter cancels and forgets a transfer's limiter, e.g. once
+// the transfer completes, fails, or is rejected.
+func cancelTransferLimiter(transferID string) {
+	limitersMu.Lock()
+	rl, ok := transferLimiters[transferID]
+	delete(transferLimiters, transferID)
+	limitersMu.Unlock()
+
+	if ok {
+		rl.cancel()
+	}
+}
+
+// throttledWriter paces writes through a per-transfer token bucket: it reads
+// up to the bucket's burst size at a time and waits for that many tokens
+// before writing.
+type throttledWriter struct {
+	w  io.Writer
+	rl *rateLimitedTransfer
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	if t.rl == nil {
+		return t.w.Write(b)
+	}
+
+	var total int
+	for total < len(b) {
+		n := len(b) - total
+		if n > limiterBurst {
+			n = limiterBurst
+		}
+
+		if err := t.rl.limiter.WaitN(t.rl.ctx, n); err != nil {
+			return total, err
+		}
+
+		written, err := t.w.Write(b[total : total+n])
+		total += written
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// throttledResponseWriter adapts throttledWriter to http.ResponseWriter so
+// handlers that hand the writer straight to http.ServeContent (which needs
+// Header/WriteHeader, not just Write) can still be rate-limited.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	rl *rateLimitedTransfer
+}
+
+func (t *throttledResponseWriter) Write(b []byte) (int, error) {
+	return (&throttledWriter{w: t.ResponseWriter, rl: t.rl}).Write(b)
+}
+
+// currentBps reports the limiter's current rate, or 0 if unlimited - the
+// same convention the -upload-limit/-download-limit flags use for "no cap".
+func (rl *rateLimitedTransfer) currentBps() float64 {
+	if rl == nil {
+		return 0
+	}
+	limit := rl.limiter.Limit()
+	if limit == rate.Inf {
+		return 0
+	}
+	return float64(limit)
+}
+
+// setTransferLimit lets the frontend slide a running transfer's bandwidth
+// cap up or down without restarting it.
+func setTransferLimit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transferID := vars["id"]
+
+	var body struct {
+		BytesPerSec float64 `json:"bytesPerSec"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	rl := getTransferLimiter(transferID)
+	if rl == nil {
+		http.Error(w, "No active limiter for this transfer", http.StatusNotFound)
+		return
+	}
+
+	if body.BytesPerSec <= 0 {
+		rl.limiter.SetLimit(rate.Inf)
+	} else {
+		rl.limiter.SetLimit(rate.Limit(body.BytesPerSec))
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
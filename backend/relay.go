@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// directDialTimeout bounds how long pullFileFromSender waits to reach a
+// peer directly before falling back to the relay.
+const directDialTimeout = 3 * time.Second
+
+// roomMessage is the first line each relay client sends after connecting,
+// identifying which transfer it's rendezvousing for and which side it is.
+type roomMessage struct {
+	Room string `json:"room"`
+	Role string `json:"role"` // "sender" or "receiver"
+}
+
+// relayRoom pairs up the two connections for a given room code.
+type relayRoom struct {
+	sender   net.Conn
+	receiver net.Conn
+}
+
+type relayServer struct {
+	mu    sync.Mutex
+	rooms map[string]*relayRoom
+}
+
+// runRelayServer runs this binary as a standalone rendezvous/proxy server:
+// two peers that can't reach each other directly (NAT, VPN, client
+// isolation) each dial in with a shared room code, and once both sides of a
+// room are present the server proxies bytes between them.
+func runRelayServer(listenAddr string) {
+	rs := &relayServer{rooms: make(map[string]*relayRoom)}
+
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		log.Fatalf("Relay server failed to listen on %s: %v", listenAddr, err)
+	}
+	log.Printf("Relay server listening on %s", listenAddr)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Relay accept error: %v", err)
+			continue
+		}
+		go rs.handleConn(conn)
+	}
+}
+
+func (rs *relayServer) handleConn(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		log.Printf("Relay: failed to read room message: %v", err)
+		conn.Close()
+		return
+	}
+
+	var msg roomMessage
+	if err := json.Unmarshal([]byte(line), &msg); err != nil || msg.Room == "" {
+		log.Printf("Relay: invalid room message: %v", err)
+		conn.Close()
+		return
+	}
+
+	rs.mu.Lock()
+	room, ok := rs.rooms[msg.Room]
+	if !ok {
+		room = &relayRoom{}
+		rs.rooms[msg.Room] = room
+	}
+	if msg.Role == "sender" {
+		room.sender = conn
+	} else {
+		room.receiver = conn
+	}
+	ready := room.sender != nil && room.receiver != nil
+	rs.mu.Unlock()
+
+	if !ready {
+		return
+	}
+
+	rs.mu.Lock()
+	sender, receiver := room.sender, room.receiver
+	delete(rs.rooms, msg.Room)
+	rs.mu.Unlock()
+
+	log.Printf("Relay: room %s ready, proxying", msg.Room)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(receiver, sender)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(sender, receiver)
+	}()
+	wg.Wait()
+
+	sender.Close()
+	receiver.Close()
+	log.Printf("Relay: room %s closed", msg.Room)
+}
+
+// relayRoomCode returns the room code a transfer uses to rendezvous on the
+// relay, assigning one via the registry (so concurrent callers can't race
+// each other writing Relay) the first time it's needed.
+func relayRoomCode(transfer *FileTransfer) string {
+	if code, ok := transferRegistry.RelayRoomCode(transfer.ID); ok {
+		return code
+	}
+	return "room-" + transfer.ID
+}
+
+// dialRelay connects to the configured relay and announces this side's role
+// for the given room.
+func dialRelay(room, role string) (net.Conn, error) {
+	if relayAddr == "" {
+		return nil, fmt.Errorf("no relay server configured")
+	}
+
+	conn, err := net.DialTimeout("tcp", relayAddr, directDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := json.Marshal(roomMessage{Room: room, Role: role})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := conn.Write(append(msg, '\n')); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// serveBlobViaRelay is the sender-side counterpart to openBlobSource's relay
+// fallback: it
+// proactively rendezvous on the relay under the transfer's room code and,
+// once a receiver shows up, streams the (possibly encrypted) file through
+// the tunnel the same way serveBlob would over HTTP.
+func serveBlobViaRelay(transfer *FileTransfer) {
+	if relayAddr == "" {
+		return
+	}
+
+	conn, err := dialRelay(relayRoomCode(transfer), "sender")
+	if err != nil {
+		log.Printf("Relay dial failed for transfer %s: %v", transfer.ID, err)
+		return
+	}
+	defer conn.Close()
+
+	rl := registerTransferLimiter(transfer.ID, effectiveLimit(transfer.UploadLimit, defaultUploadLimitBps))
+	defer cancelTransferLimiter(transfer.ID)
+	throttled := &throttledWriter{w: conn, rl: rl}
+
+	if transfer.IsArchive {
+		// Archive transfers are tarred up on the fly from archiveSources and
+		// never hit disk as a single blob, so they go through the same tar
+		// pipe serveArchiveBlob uses instead of tempFilePath.
+		if err := streamArchiveBlob(throttled, transfer); err != nil {
+			log.Printf("Relay: error streaming archive for transfer %s: %v", transfer.ID, err)
+		}
+		return
+	}
+
+	tempPath := tempFilePath(transfer.ID, transfer.Filename)
+	file, err := os.Open(tempPath)
+	if err != nil {
+		log.Printf("Relay: could not open file for transfer %s: %v", transfer.ID, err)
+		return
+	}
+	defer file.Close()
+
+	if err := copyForTransfer(throttled, file, transfer); err != nil {
+		log.Printf("Relay: error streaming transfer %s: %v", transfer.ID, err)
+	}
+}
+
+// openBlobSource tries to dial the sender directly (bounded by
+// directDialTimeout) and, if that fails, falls back to rendezvousing on the
+// relay. It returns the effective offset the stream actually starts at,
+// which may be 0 even if a larger offset was requested (the relay and a
+// sender that ignores Range both only offer the stream from the start).
+func openBlobSource(transfer *FileTransfer, offset int64) (io.ReadCloser, int64, error) {
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{Timeout: directDialTimeout}).DialContext,
+	}
+	client := &http.Client{Transport: transport}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s:%s/api/blob/%s", transfer.FromIP, serverPort, transfer.ID), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := client.Do(req)
+	if err == nil {
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("sender returned %s", resp.Status)
+		}
+		effectiveOffset := offset
+		if offset > 0 && resp.StatusCode == http.StatusOK {
+			effectiveOffset = 0
+		}
+		return resp.Body, effectiveOffset, nil
+	}
+
+	log.Printf("Direct dial to %s failed for transfer %s, falling back to relay: %v", transfer.FromIP, transfer.ID, err)
+
+	if ferr := requestRelayFallback(transfer.FromIP, transfer.ID, relayFallbackBlob); ferr != nil {
+		return nil, 0, fmt.Errorf("direct dial failed (%v) and relay fallback request failed (%v)", err, ferr)
+	}
+
+	conn, rerr := dialRelay(relayRoomCode(transfer), "receiver")
+	if rerr != nil {
+		return nil, 0, fmt.Errorf("direct dial failed (%v) and relay fallback failed (%v)", err, rerr)
+	}
+	return conn, 0, nil
+}
+
+// relayFallbackKind selects which of the sender's relay rendezvous points
+// startRelayFallback should join - the blob transfer itself, or (for secure
+// transfers that also failed to dial directly) the PAKE handshake that has
+// to complete before any blob bytes can be decrypted.
+type relayFallbackKind string
+
+const (
+	relayFallbackBlob relayFallbackKind = "blob"
+	relayFallbackPake relayFallbackKind = "pake"
+)
+
+// requestRelayFallback asks the sender to rendezvous on the relay for this
+// transfer. It's only called once a direct dial has actually failed, so the
+// sender never pays for a relay connection (and the file descriptor it
+// holds open) on the common path where peers can reach each other directly.
+func requestRelayFallback(senderIP, transferID string, kind relayFallbackKind) error {
+	client := &http.Client{Timeout: directDialTimeout}
+	resp, err := client.Post(
+		fmt.Sprintf("http://%s:%s/api/relay-fallback/%s?kind=%s", senderIP, serverPort, transferID, kind),
+		"application/json",
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sender returned %s", resp.Status)
+	}
+	return nil
+}
+
+// startRelayFallback is the sender-side handler a receiver calls after its
+// direct dial has failed: depending on ?kind, it kicks off either
+// serveBlobViaRelay or servePakeHandshakeViaRelay so the sender joins the
+// same relay room the receiver is about to dial into.
+func startRelayFallback(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transferID := vars["transferId"]
+
+	transfer, exists := transferRegistry.Get(transferID)
+	if !exists {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+
+	switch relayFallbackKind(r.URL.Query().Get("kind")) {
+	case relayFallbackPake:
+		go servePakeHandshakeViaRelay(transfer)
+	default:
+		go serveBlobViaRelay(transfer)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func getRelayInfo(w http.ResponseWriter, r *http.Request) {
+	transferID := r.URL.Query().Get("transferId")
+
+	room := ""
+	if transferID != "" {
+		if transfer, ok := transferRegistry.Get(transferID); ok {
+			room = relayRoomCode(transfer)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"relayAddr": relayAddr,
+		"room":      room,
+	})
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/schollz/pake/v3"
+)
+
+// secureChunkSize is the plaintext size of each AES-GCM frame. Keeping it
+// fixed bounds the memory each frame needs and lets copyFromTransfer reject
+// any frame longer than one chunk plus the GCM tag. A chunk that fails
+// authentication aborts the whole stream.
+const secureChunkSize = 64 * 1024
+
+// codePhraseWords is a small, unambiguous word list used to build the
+// "3-word-list" phrase the user reads aloud or types over a side channel.
+var codePhraseWords = []string{
+	"anchor", "basil", "cedar", "delta", "ember", "falcon", "granite", "harbor",
+	"indigo", "jasper", "kernel", "lagoon", "maple", "nimbus", "onyx", "pebble",
+	"quartz", "raven", "sable", "tundra", "umber", "violet", "willow", "yonder",
+	"zephyr", "amber", "birch", "comet", "drift", "ferry",
+}
+
+// pakeSession holds one side's in-progress PAKE exchange for a transfer.
+type pakeSession struct {
+	pake *pake.Pake
+	key  []byte
+}
+
+var (
+	pakeSessionsMu sync.Mutex
+	pakeSessions   = make(map[string]*pakeSession)
+)
+
+func newCodePhrase() (string, error) {
+	words := make([]string, 3)
+	for i := range words {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codePhraseWords))))
+		if err != nil {
+			return "", err
+		}
+		words[i] = codePhraseWords[n.Int64()]
+	}
+	return words[0] + "-" + words[1] + "-" + words[2], nil
+}
+
+// startPakeSession initializes the sender's (responder) side of the PAKE
+// exchange, keyed by the transfer it belongs to.
+func startPakeSession(transferID, codePhrase string) error {
+	weakKey := sha256.Sum256([]byte(codePhrase))
+
+	b, err := pake.InitCurve(weakKey[:], 1, "siec")
+	if err != nil {
+		return err
+	}
+
+	pakeSessionsMu.Lock()
+	pakeSessions[transferID] = &pakeSession{pake: b}
+	pakeSessionsMu.Unlock()
+
+	return nil
+}
+
+// runPakeResponderRound feeds the initiator's (receiver's) PAKE message into
+// the sender's in-progress session, derives the shared key, and returns the
+// sender's counter-message - the half of the handshake both handlePake
+// (direct, over HTTP) and servePakeHandshakeViaRelay (over the relay) share.
+func runPakeResponderRound(transferID string, peerBytes []byte) ([]byte, error) {
+	pakeSessionsMu.Lock()
+	session, ok := pakeSessions[transferID]
+	pakeSessionsMu.Unlock()
+	if !ok {
+		return nil, errors.New("no PAKE session for this transfer")
+	}
+
+	if err := session.pake.Update(peerBytes); err != nil {
+		return nil, err
+	}
+
+	key, err := session.pake.SessionKey()
+	if err != nil {
+		return nil, err
+	}
+	session.key = deriveTransferKey(key)
+
+	return session.pake.Bytes(), nil
+}
+
+// handlePake is the sender's side of the handshake: the receiver posts its
+// PAKE round message along with the transfer id, and this returns the
+// sender's counter-message so both sides can derive the shared key.
+func handlePake(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transferID := vars["transferId"]
+
+	transfer, exists := transferRegistry.Get(transferID)
+	if !exists {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+
+	if !transfer.Secure {
+		http.Error(w, "Transfer is not in secure mode", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		PakeBytes []byte `json:"pakeBytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	responseBytes, err := runPakeResponderRound(transferID, body.PakeBytes)
+	if err != nil {
+		http.Error(w, "PAKE handshake failed", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]byte{"pakeBytes": responseBytes})
+}
+
+// servePakeHandshakeViaRelay is the sender-side counterpart to
+// completePakeHandshakeViaRelay: it rendezvous on the relay under the
+// transfer's PAKE room and runs the same responder round handlePake runs
+// over HTTP, framed as a single newline-delimited JSON message each way
+// instead of an HTTP request/response.
+func servePakeHandshakeViaRelay(transfer *FileTransfer) {
+	conn, err := dialRelay(pakeRelayRoomCode(transfer), "sender")
+	if err != nil {
+		log.Printf("Relay dial failed for PAKE handshake on transfer %s: %v", transfer.ID, err)
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		log.Printf("Error reading PAKE round over relay for transfer %s: %v", transfer.ID, err)
+		return
+	}
+
+	var body struct {
+		PakeBytes []byte `json:"pakeBytes"`
+	}
+	if err := json.Unmarshal([]byte(line), &body); err != nil {
+		log.Printf("Invalid PAKE round over relay for transfer %s: %v", transfer.ID, err)
+		return
+	}
+
+	responseBytes, err := runPakeResponderRound(transfer.ID, body.PakeBytes)
+	if err != nil {
+		log.Printf("PAKE handshake over relay failed for transfer %s: %v", transfer.ID, err)
+		return
+	}
+
+	msg, err := json.Marshal(map[string][]byte{"pakeBytes": responseBytes})
+	if err != nil {
+		log.Printf("Error encoding PAKE response over relay for transfer %s: %v", transfer.ID, err)
+		return
+	}
+	if _, err := conn.Write(append(msg, '\n')); err != nil {
+		log.Printf("Error writing PAKE response over relay for transfer %s: %v", transfer.ID, err)
+	}
+}
+
+// completePakeHandshake runs the receiver's (initiator) side of the
+// handshake against the sender's /api/pake endpoint using the code phrase
+// the user entered, falling back to the relay (the same way openBlobSource
+// falls back for the blob itself) if the sender can't be dialed directly -
+// otherwise a secure transfer could never use the relay it's meant to
+// stream already-encrypted chunks through.
+func completePakeHandshake(transfer *FileTransfer, codePhrase string) error {
+	if codePhrase == "" {
+		return errors.New("code phrase required for secure transfer")
+	}
+
+	weakKey := sha256.Sum256([]byte(codePhrase))
+
+	a, err := pake.InitCurve(weakKey[:], 0, "siec")
+	if err != nil {
+		return err
+	}
+
+	reqBody, err := json.Marshal(map[string][]byte{"pakeBytes": a.Bytes()})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: directDialTimeout}
+	resp, err := client.Post(
+		fmt.Sprintf("http://%s:%s/api/pake/%s", transfer.FromIP, serverPort, transfer.ID),
+		"application/json",
+		bytes.NewReader(reqBody),
+	)
+	if err != nil {
+		log.Printf("Direct PAKE dial to %s failed for transfer %s, falling back to relay: %v", transfer.FromIP, transfer.ID, err)
+		return completePakeHandshakeViaRelay(transfer, a)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sender rejected PAKE handshake: %s", resp.Status)
+	}
+
+	var respBody struct {
+		PakeBytes []byte `json:"pakeBytes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return err
+	}
+
+	if err := a.Update(respBody.PakeBytes); err != nil {
+		return err
+	}
+
+	key, err := a.SessionKey()
+	if err != nil {
+		return err
+	}
+
+	pakeSessionsMu.Lock()
+	pakeSessions[transfer.ID] = &pakeSession{pake: a, key: deriveTransferKey(key)}
+	pakeSessionsMu.Unlock()
+
+	return nil
+}
+
+// pakeRelayRoomCode derives the relay room the PAKE handshake rendezvous
+// under - distinct from the blob transfer's own room code, since the two
+// rendezvous independently and the relay server deletes a room as soon as
+// its pair connects.
+func pakeRelayRoomCode(transfer *FileTransfer) string {
+	return relayRoomCode(transfer) + "-pake"
+}
+
+// completePakeHandshakeViaRelay is completePakeHandshake's relay fallback:
+// it asks the sender to join the PAKE room (the same way requestRelayFallback
+// asks it to join the blob room) and runs the initiator round over that
+// connection instead of HTTP.
+func completePakeHandshakeViaRelay(transfer *FileTransfer, a *pake.Pake) error {
+	if err := requestRelayFallback(transfer.FromIP, transfer.ID, relayFallbackPake); err != nil {
+		return fmt.Errorf("direct PAKE dial failed and relay fallback failed: %w", err)
+	}
+
+	conn, err := dialRelay(pakeRelayRoomCode(transfer), "receiver")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	msg, err := json.Marshal(map[string][]byte{"pakeBytes": a.Bytes()})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(msg, '\n')); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	var respBody struct {
+		PakeBytes []byte `json:"pakeBytes"`
+	}
+	if err := json.Unmarshal([]byte(line), &respBody); err != nil {
+		return err
+	}
+
+	if err := a.Update(respBody.PakeBytes); err != nil {
+		return err
+	}
+
+	key, err := a.SessionKey()
+	if err != nil {
+		return err
+	}
+
+	pakeSessionsMu.Lock()
+	pakeSessions[transfer.ID] = &pakeSession{pake: a, key: deriveTransferKey(key)}
+	pakeSessionsMu.Unlock()
+
+	return nil
+}
+
+// deriveTransferKey turns the raw PAKE session key into a fixed-size AES-256
+// key.
+func deriveTransferKey(sessionKey []byte) []byte {
+	key := sha256.Sum256(sessionKey)
+	return key[:]
+}
+
+func transferKey(transferID string) ([]byte, bool) {
+	pakeSessionsMu.Lock()
+	defer pakeSessionsMu.Unlock()
+	session, ok := pakeSessions[transferID]
+	if !ok || session.key == nil {
+		return nil, false
+	}
+	return session.key, true
+}
+
+// chunkNonce derives a per-chunk nonce from the transfer id and chunk
+// counter so no nonce is ever reused under a given key.
+func chunkNonce(transferID string, counter uint64) []byte {
+	h := sha256.New()
+	h.Write([]byte(transferID))
+	var counterBytes [8]byte
+	binary.BigEndian.PutUint64(counterBytes[:], counter)
+	h.Write(counterBytes[:])
+	return h.Sum(nil)[:12]
+}
+
+// copyForTransfer streams src to dst, transparently encrypting it in fixed
+// size AES-GCM chunks (each framed with a length prefix) when the transfer
+// is in secure mode.
+func copyForTransfer(dst io.Writer, src io.Reader, transfer *FileTransfer) error {
+	if !transfer.Secure {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	key, ok := transferKey(transfer.ID)
+	if !ok {
+		return errors.New("no secure session key for transfer")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, secureChunkSize)
+	var counter uint64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			ciphertext := gcm.Seal(nil, chunkNonce(transfer.ID, counter), buf[:n], nil)
+			var lenPrefix [4]byte
+			binary.BigEndian.PutUint32(lenPrefix[:], uint32(len(ciphertext)))
+			if _, werr := dst.Write(lenPrefix[:]); werr != nil {
+				return werr
+			}
+			if _, werr := dst.Write(ciphertext); werr != nil {
+				return werr
+			}
+			counter++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyFromTransfer is the inverse of copyForTransfer: it reads length-framed
+// AES-GCM chunks from src and writes the verified plaintext to dst. It
+// returns an error (and leaves dst short) if any chunk fails authentication.
+func copyFromTransfer(dst io.Writer, src io.Reader, transfer *FileTransfer) error {
+	if !transfer.Secure {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+
+	key, ok := transferKey(transfer.ID)
+	if !ok {
+		return errors.New("no secure session key for transfer")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	var counter uint64
+	for {
+		var lenPrefix [4]byte
+		if _, err := io.ReadFull(src, lenPrefix[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		chunkLen := binary.BigEndian.Uint32(lenPrefix[:])
+		if maxChunkLen := uint32(secureChunkSize + gcm.Overhead()); chunkLen > maxChunkLen {
+			return fmt.Errorf("chunk %d length %d exceeds max frame size %d", counter, chunkLen, maxChunkLen)
+		}
+		ciphertext := make([]byte, chunkLen)
+		if _, err := io.ReadFull(src, ciphertext); err != nil {
+			return err
+		}
+
+		plaintext, err := gcm.Open(nil, chunkNonce(transfer.ID, counter), ciphertext, nil)
+		if err != nil {
+			return fmt.Errorf("chunk %d failed auth check: %w", counter, err)
+		}
+
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+		counter++
+	}
+}
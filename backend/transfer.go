@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// progressInterval caps how often transfer_progress is broadcast over the
+// WebSocket, so a fast LAN transfer doesn't flood every client.
+const progressInterval = 250 * time.Millisecond
+
+func tempFilePath(transferID, filename string) string {
+	tempDir := filepath.Join(os.TempDir(), "file-share")
+	os.MkdirAll(tempDir, 0o755)
+	return filepath.Join(tempDir, transferID+"_"+filename)
+}
+
+// sidecarPath returns the path of the small JSON file that tracks how much
+// of a .part download has been committed to disk, so a resume can pick up
+// where it left off.
+func sidecarPath(partPath string) string {
+	return partPath + ".json"
+}
+
+type pullState struct {
+	Offset int64 `json:"offset"`
+}
+
+func readPullState(partPath string) pullState {
+	data, err := os.ReadFile(sidecarPath(partPath))
+	if err != nil {
+		return pullState{}
+	}
+	var state pullState
+	json.Unmarshal(data, &state)
+	return state
+}
+
+func writePullState(partPath string, state pullState) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	os.WriteFile(sidecarPath(partPath), data, 0o644)
+}
+
+// serveBlob streams the sender's temp file to a peer, supporting Range
+// requests for plain transfers so a dropped connection can resume. Secure
+// transfers are served as a single AES-GCM chunked stream, since the chunk
+// framing doesn't line up with arbitrary byte ranges.
+func serveBlob(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	transferID := vars["transferId"]
+
+	transfer, exists := transferRegistry.Get(transferID)
+	if !exists {
+		http.Error(w, "Transfer not found", http.StatusNotFound)
+		return
+	}
+
+	if transfer.IsArchive {
+		serveArchiveBlob(w, transfer)
+		return
+	}
+
+	tempPath := tempFilePath(transferID, transfer.Filename)
+	file, err := os.Open(tempPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	rl := registerTransferLimiter(transferID, effectiveLimit(transfer.UploadLimit, defaultUploadLimitBps))
+	defer cancelTransferLimiter(transferID)
+	throttled := &throttledResponseWriter{ResponseWriter: w, rl: rl}
+
+	if transfer.Secure {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Accept-Ranges", "none")
+		if err := copyForTransfer(throttled, file, transfer); err != nil {
+			log.Printf("Error streaming secure blob for transfer %s: %v", transferID, err)
+		}
+		return
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(throttled, r, transfer.Filename, info.ModTime(), file)
+}
+
+// pullFileFromSender is the receiver side of the redesigned transfer path:
+// it streams the file straight to a .part file on disk, resuming from the
+// last committed offset (tracked in a JSON sidecar) if a previous attempt
+// was interrupted, then verifies the assembled file against transfer.Hash.
+func pullFileFromSender(transfer *FileTransfer) {
+	if transfer.IsArchive {
+		pullArchiveFromSender(transfer)
+		return
+	}
+
+	finalPath := tempFilePath(transfer.ID, transfer.Filename)
+	partPath := finalPath + ".part"
+
+	var offset int64
+	if transfer.Secure {
+		// Secure transfers can't resume mid-stream (see serveBlob), so
+		// always start clean.
+		os.Remove(partPath)
+	} else {
+		offset = readPullState(partPath).Offset
+	}
+
+	out, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Error opening part file for transfer %s: %v", transfer.ID, err)
+		return
+	}
+	defer out.Close()
+
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("Error seeking part file for transfer %s: %v", transfer.ID, err)
+		return
+	}
+
+	src, effectiveOffset, err := openBlobSource(transfer, offset)
+	if err != nil {
+		log.Printf("Error pulling file for transfer %s: %v", transfer.ID, err)
+		return
+	}
+	defer src.Close()
+
+	// The relay (and a sender that ignored our Range header) can only offer
+	// the stream from the start, so restart the .part file if our resume
+	// point wasn't honored.
+	if effectiveOffset != offset {
+		offset = effectiveOffset
+		out.Seek(0, io.SeekStart)
+		out.Truncate(0)
+	}
+
+	rl := registerTransferLimiter(transfer.ID, effectiveLimit(transfer.DownloadLimit, defaultDownloadLimitBps))
+	defer cancelTransferLimiter(transfer.ID)
+
+	progressDst := &progressTrackingWriter{
+		w:         &throttledWriter{w: out, rl: rl},
+		transfer:  transfer,
+		written:   offset,
+		total:     transfer.Size,
+		lastBeat:  time.Now(),
+		lastBytes: offset,
+		rl:        rl,
+	}
+
+	if err := copyFromTransfer(progressDst, src, transfer); err != nil {
+		log.Printf("Error pulling file for transfer %s: %v", transfer.ID, err)
+		writePullState(partPath, pullState{Offset: progressDst.written})
+		return
+	}
+
+	out.Close()
+
+	// Per-chunk GCM auth (secure mode) only proves each chunk wasn't
+	// tampered with, not that the stream wasn't truncated at a chunk
+	// boundary - exactly the kind of active-attacker cut secure mode exists
+	// to defend against. copyFromTransfer decrypts secure transfers back to
+	// plaintext before it ever reaches partPath, so the sender's hash (taken
+	// over the plaintext before encryption, see sendFile) still applies and
+	// catches a short file the same way it does for a plain transfer.
+	if err := verifyHash(partPath, transfer.Hash); err != nil {
+		log.Printf("Hash verification failed for transfer %s: %v", transfer.ID, err)
+		updated, _ := transferRegistry.SetStatus(transfer.ID, "rejected")
+		broadcastMessage("transfer_rejected", updated)
+		os.Remove(partPath)
+		os.Remove(sidecarPath(partPath))
+		return
+	}
+
+	if err := os.Rename(partPath, finalPath); err != nil {
+		log.Printf("Error finalizing transfer %s: %v", transfer.ID, err)
+		return
+	}
+	os.Remove(sidecarPath(partPath))
+
+	updated, _ := transferRegistry.SetStatus(transfer.ID, "completed")
+	broadcastMessage("transfer_completed", updated)
+	log.Printf("Transfer %s completed and verified", transfer.ID)
+}
+
+func verifyHash(path, expected string) error {
+	if expected == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != expected {
+		return fmt.Errorf("hash mismatch: expected %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+// progressTrackingWriter wraps the destination file so pullFileFromSender
+// can broadcast transfer_progress messages without the decrypt/copy loop
+// knowing anything about the WebSocket.
+type progressTrackingWriter struct {
+	w         io.Writer
+	transfer  *FileTransfer
+	written   int64
+	total     int64
+	lastBeat  time.Time
+	lastBytes int64
+	rl        *rateLimitedTransfer
+}
+
+func (p *progressTrackingWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+
+	if time.Since(p.lastBeat) >= progressInterval {
+		elapsed := time.Since(p.lastBeat).Seconds()
+		bytesPerSec := float64(p.written-p.lastBytes) / elapsed
+
+		broadcastMessage("transfer_progress", map[string]interface{}{
+			"id":               p.transfer.ID,
+			"transferred":      p.written,
+			"total":            p.total,
+			"bytesPerSec":      bytesPerSec,
+			"limitBytesPerSec": p.rl.currentBps(),
+		})
+
+		if !p.transfer.IsArchive {
+			writePullState(tempFilePath(p.transfer.ID, p.transfer.Filename)+".part", pullState{Offset: p.written})
+		}
+
+		p.lastBeat = time.Now()
+		p.lastBytes = p.written
+	}
+
+	return n, err
+}